@@ -1,17 +1,30 @@
 package main_test
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/pivotal-cf/on-demand-service-broker/service"
 )
@@ -67,26 +80,569 @@ var _ = Describe("ExampleServiceInstancesApi", func() {
 		assertServiceInstanceList(url, []service.Instance{{GUID: "instance2", PlanUniqueID: "plan2"}})
 	})
 
+	It("returns the optional instance fields unchanged", func() {
+		instances := `[{
+			"service_instance_id": "instance1",
+			"plan_id": "plan1",
+			"name": "my-instance",
+			"space_guid": "space1",
+			"space_name": "dev",
+			"organization_guid": "org1",
+			"organization_name": "acme",
+			"labels": {"team": "data"},
+			"annotations": {"owner": "someone@example.com"},
+			"maintenance_info": {"version": "1.2.3"}
+		}]`
+		postWithBasicAuth(url, instances)
+
+		resp, err := getWithBasicAuth(url)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		content, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(content).To(MatchJSON(instances))
+	})
+
+	It("returns the content previous set for repeated params regardless of their order", func() {
+		postWithBasicAuth(url+"?cf_org=a&cf_org=b", `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
+
+		assertServiceInstanceList(url+"?cf_org=b&cf_org=a", []service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}})
+		assertServiceInstanceList(url+"?cf_org=a", []service.Instance{})
+	})
+
 	It("fails with 4xx code when it POSTs a status-code=400 param", func() {
 		urlWithParams := url + "?a=b&status-code=400"
 		postWithBasicAuth(urlWithParams, `[]`)
-		assertErrorResponse(url, http.StatusBadRequest)
+		assertErrorResponse(url+"?a=b", http.StatusBadRequest)
 	})
 
 	It("fails with 5xx code when it POSTs a status-code=500 param", func() {
 		urlWithParams := url + "?a=b&status-code=500&c=2"
 		postWithBasicAuth(urlWithParams, `[]`)
-		assertErrorResponse(url, http.StatusInternalServerError)
+		assertErrorResponse(url+"?c=2&a=b", http.StatusInternalServerError)
 	})
 
 	It("does not fail if status-code is unset via a status-code=200 param", func() {
 		urlWithParams := url + "?a=b&status-code=400"
 		postWithBasicAuth(urlWithParams, `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
-		assertErrorResponse(url, http.StatusBadRequest)
+		assertErrorResponse(url+"?a=b", http.StatusBadRequest)
 		urlWithUnsetParams := url + "?a=b&status-code=200"
 		postWithBasicAuth(urlWithUnsetParams, `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
 		assertServiceInstanceList(url+"?a=b", []service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}})
 	})
+
+	It("only fails for the params the status-code was POSTed with", func() {
+		postWithBasicAuth(url+"?cf_org=a&cf_space=b", `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
+		postWithBasicAuth(url+"?cf_org=a&cf_space=c", `[{"service_instance_id":"instance2","plan_id":"plan1"}]`)
+		postWithBasicAuth(url+"?cf_org=a&cf_space=b&status-code=500", `[]`)
+
+		assertErrorResponse(url+"?cf_org=a&cf_space=b", http.StatusInternalServerError)
+		assertServiceInstanceList(url+"?cf_org=a&cf_space=c", []service.Instance{{GUID: "instance2", PlanUniqueID: "plan1"}})
+		assertServiceInstanceList(url, []service.Instance{})
+	})
+
+	It("returns the error-description POSTed with the status-code", func() {
+		postWithBasicAuth(url+"?a=b&status-code=503&error-description=maintenance%20in%20progress", `[]`)
+		assertErrorResponseWithDescription(url+"?a=b", http.StatusServiceUnavailable, "maintenance in progress")
+	})
+
+	It("delays the error response by the delay POSTed with the status-code", func() {
+		postWithBasicAuth(url+"?a=b&status-code=500&delay=500ms", `[]`)
+
+		start := time.Now()
+		assertErrorResponse(url+"?a=b", http.StatusInternalServerError)
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+	})
+
+	It("rejects a POST with an invalid delay", func() {
+		resp, err := postWithBasicAuth(url+"?a=b&status-code=500&delay=soon", `[]`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		assertServiceInstanceList(url+"?a=b", []service.Instance{})
+	})
+
+	It("rejects a POST with an out of range status-code", func() {
+		resp, err := postWithBasicAuth(url+"?a=b&status-code=1000", `[]`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	Context("when a sequence of responses is POSTed", func() {
+		It("returns the responses in order and then keeps returning the last one", func() {
+			resp, err := postWithBasicAuth(url+"?cf_org=a&sequence=true", `[
+				{"status_code": 503, "body": {"description": "try again"}},
+				{"status_code": 500},
+				{"body": [{"service_instance_id":"instance1","plan_id":"plan1"}]}
+			]`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			assertErrorResponseWithDescription(url+"?cf_org=a", http.StatusServiceUnavailable, "try again")
+			assertErrorResponse(url+"?cf_org=a", http.StatusInternalServerError)
+			assertServiceInstanceList(url+"?cf_org=a", []service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}})
+			assertServiceInstanceList(url+"?cf_org=a", []service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}})
+		})
+
+		It("does not affect other params", func() {
+			postWithBasicAuth(url+"?cf_org=a&sequence=true", `[{"status_code": 503}]`)
+			assertServiceInstanceList(url+"?cf_org=b", []service.Instance{})
+			assertServiceInstanceList(url, []service.Instance{})
+		})
+
+		It("delays each response by its delay", func() {
+			postWithBasicAuth(url+"?sequence=true", `[{"delay": "500ms"}, {}]`)
+
+			start := time.Now()
+			assertServiceInstanceList(url, []service.Instance{})
+			Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+
+			start = time.Now()
+			assertServiceInstanceList(url, []service.Instance{})
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+
+		It("is replaced by a later service instance list", func() {
+			postWithBasicAuth(url+"?sequence=true", `[{"status_code": 503}]`)
+			postWithBasicAuth(url, `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
+			assertServiceInstanceList(url, []service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}})
+		})
+
+		It("is overridden by a forced error", func() {
+			postWithBasicAuth(url+"?sequence=true", `[{}]`)
+			postWithBasicAuth(url+"?status-code=500", `[]`)
+			assertErrorResponse(url, http.StatusInternalServerError)
+		})
+
+		It("rejects an invalid sequence", func() {
+			for _, body := range []string{`{}`, `[]`, `[{"status_code": 42}]`, `[{"delay": "soon"}]`} {
+				resp, err := postWithBasicAuth(url+"?sequence=true", body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest), body)
+			}
+		})
+	})
+
+	Describe("/requests", func() {
+		type recordedRequest struct {
+			Time        time.Time           `json:"time"`
+			QueryParams map[string][]string `json:"query_params"`
+			User        string              `json:"user"`
+			Headers     map[string][]string `json:"headers"`
+		}
+
+		var requestsURL string
+
+		BeforeEach(func() {
+			requestsURL = fmt.Sprintf("http://localhost:%s/requests", appPort)
+		})
+
+		getRequests := func() []recordedRequest {
+			resp, err := getWithBasicAuth(requestsURL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			var requests []recordedRequest
+			Expect(json.NewDecoder(resp.Body).Decode(&requests)).To(Succeed())
+			return requests
+		}
+
+		It("requires basic authentication", func() {
+			resp, err := http.Get(requestsURL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("returns the GET requests received for service instances", func() {
+			start := time.Now()
+			postWithBasicAuth(url+"?cf_org=a", `[]`)
+			getWithErrorHeader(url+"?cf_org=a&cf_space=b", "X-Test", "some-value")
+			getWithBasicAuth(url)
+
+			requests := getRequests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[0].Time).To(BeTemporally(">=", start.Truncate(time.Second)))
+			Expect(requests[0].QueryParams).To(Equal(map[string][]string{"cf_org": {"a"}, "cf_space": {"b"}}))
+			Expect(requests[0].User).To(Equal(username))
+			Expect(requests[0].Headers).To(HaveKeyWithValue("X-Test", []string{"some-value"}))
+			Expect(requests[0].Headers).NotTo(HaveKey("Authorization"))
+			Expect(requests[1].QueryParams).To(BeEmpty())
+		})
+
+		It("clears the received requests on DELETE", func() {
+			getWithBasicAuth(url)
+
+			resp, err := reqWithBasicAuth(requestsURL, "DELETE", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+			Expect(getRequests()).To(BeEmpty())
+		})
+
+		Context("when REQUEST_LOG_SIZE is set", func() {
+			BeforeEach(func() {
+				os.Setenv("REQUEST_LOG_SIZE", "2")
+				restartServer()
+			})
+
+			AfterEach(func() {
+				os.Unsetenv("REQUEST_LOG_SIZE")
+			})
+
+			It("returns only the most recent requests", func() {
+				getWithBasicAuth(url + "?n=1")
+				getWithBasicAuth(url + "?n=2")
+				getWithBasicAuth(url + "?n=3")
+
+				requests := getRequests()
+				Expect(requests).To(HaveLen(2))
+				Expect(requests[0].QueryParams).To(Equal(map[string][]string{"n": {"2"}}))
+				Expect(requests[1].QueryParams).To(Equal(map[string][]string{"n": {"3"}}))
+			})
+		})
+	})
+
+	Context("when PAGE_SIZE is set", func() {
+		type instancesPage struct {
+			ServiceInstances []service.Instance `json:"service_instances"`
+			NextPageURL      string             `json:"next_page_url"`
+		}
+
+		BeforeEach(func() {
+			os.Setenv("PAGE_SIZE", "2")
+			restartServer()
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("PAGE_SIZE")
+		})
+
+		getPage := func(url string) instancesPage {
+			resp, err := getWithBasicAuth(url)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			var page instancesPage
+			Expect(json.NewDecoder(resp.Body).Decode(&page)).To(Succeed())
+			return page
+		}
+
+		It("returns the instance list in pages linked by next_page_url", func() {
+			postWithBasicAuth(url+"?cf_org=a", `[
+				{"service_instance_id":"instance1","plan_id":"plan1"},
+				{"service_instance_id":"instance2","plan_id":"plan1"},
+				{"service_instance_id":"instance3","plan_id":"plan1"}
+			]`)
+
+			page := getPage(url + "?cf_org=a")
+			Expect(page.ServiceInstances).To(Equal([]service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}, {GUID: "instance2", PlanUniqueID: "plan1"}}))
+			Expect(page.NextPageURL).To(Equal("/service_instances?cf_org=a&page=2"))
+
+			page = getPage(fmt.Sprintf("http://localhost:%s%s", appPort, page.NextPageURL))
+			Expect(page.ServiceInstances).To(Equal([]service.Instance{{GUID: "instance3", PlanUniqueID: "plan1"}}))
+			Expect(page.NextPageURL).To(BeEmpty())
+		})
+
+		It("returns an empty page when there are no instances", func() {
+			page := getPage(url)
+			Expect(page.ServiceInstances).To(BeEmpty())
+			Expect(page.NextPageURL).To(BeEmpty())
+
+			page = getPage(url + "?page=3")
+			Expect(page.ServiceInstances).To(BeEmpty())
+		})
+
+		It("rejects an invalid page", func() {
+			resp, err := getWithBasicAuth(url + "?page=0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("returns an empty page for a page far past the end", func() {
+			postWithBasicAuth(url, `[
+				{"service_instance_id":"instance1","plan_id":"plan1"},
+				{"service_instance_id":"instance2","plan_id":"plan1"},
+				{"service_instance_id":"instance3","plan_id":"plan1"}
+			]`)
+
+			page := getPage(url + "?page=9223372036854775807")
+			Expect(page.ServiceInstances).To(BeEmpty())
+			Expect(page.NextPageURL).To(BeEmpty())
+		})
+
+		It("still fails with a forced error", func() {
+			postWithBasicAuth(url+"?status-code=500", `[]`)
+			assertErrorResponse(url+"?page=2", http.StatusInternalServerError)
+		})
+
+		It("returns a forced error rather than rejecting an invalid page", func() {
+			postWithBasicAuth(url+"?status-code=503", `[]`)
+			assertErrorResponse(url+"?page=0", http.StatusServiceUnavailable)
+		})
+
+		It("returns scripted instance lists in pages", func() {
+			postWithBasicAuth(url+"?sequence=true", `[
+				{"status_code": 503},
+				{"body": [
+					{"service_instance_id":"instance1","plan_id":"plan1"},
+					{"service_instance_id":"instance2","plan_id":"plan1"},
+					{"service_instance_id":"instance3","plan_id":"plan1"}
+				]}
+			]`)
+
+			assertErrorResponse(url, http.StatusServiceUnavailable)
+
+			page := getPage(url)
+			Expect(page.ServiceInstances).To(Equal([]service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}, {GUID: "instance2", PlanUniqueID: "plan1"}}))
+			Expect(page.NextPageURL).To(Equal("/service_instances?page=2"))
+
+			page = getPage(url + "?page=2")
+			Expect(page.ServiceInstances).To(Equal([]service.Instance{{GUID: "instance3", PlanUniqueID: "plan1"}}))
+		})
+
+		It("only moves a scripted sequence on for a first page", func() {
+			postWithBasicAuth(url+"?sequence=true", `[
+				{"body": [
+					{"service_instance_id":"a1","plan_id":"plan1"},
+					{"service_instance_id":"a2","plan_id":"plan1"},
+					{"service_instance_id":"a3","plan_id":"plan1"}
+				]},
+				{"body": [
+					{"service_instance_id":"b1","plan_id":"plan1"},
+					{"service_instance_id":"b2","plan_id":"plan1"},
+					{"service_instance_id":"b3","plan_id":"plan1"}
+				]}
+			]`)
+
+			Expect(getPage(url).ServiceInstances).To(Equal([]service.Instance{{GUID: "a1", PlanUniqueID: "plan1"}, {GUID: "a2", PlanUniqueID: "plan1"}}))
+			Expect(getPage(url + "?page=2").ServiceInstances).To(Equal([]service.Instance{{GUID: "a3", PlanUniqueID: "plan1"}}))
+			Expect(getPage(url + "?page=2").ServiceInstances).To(Equal([]service.Instance{{GUID: "a3", PlanUniqueID: "plan1"}}))
+
+			Expect(getPage(url + "?page=1").ServiceInstances).To(Equal([]service.Instance{{GUID: "b1", PlanUniqueID: "plan1"}, {GUID: "b2", PlanUniqueID: "plan1"}}))
+			Expect(getPage(url + "?page=2").ServiceInstances).To(Equal([]service.Instance{{GUID: "b3", PlanUniqueID: "plan1"}}))
+		})
+	})
+
+	Context("when JWT_SIGNING_KEY is set", func() {
+		var signingKey *rsa.PrivateKey
+
+		BeforeEach(func() {
+			var err error
+			signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(signingKey)})
+			os.Setenv("JWT_SIGNING_KEY", string(keyPEM))
+			restartServer()
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("JWT_SIGNING_KEY")
+		})
+
+		It("accepts a token obtained with the client credentials grant", func() {
+			postWithBasicAuth(url, `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
+
+			token := obtainToken(username, password)
+
+			resp, err := getWithBearerToken(url, token)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var instances []service.Instance
+			Expect(json.NewDecoder(resp.Body).Decode(&instances)).To(Succeed())
+			Expect(instances).To(Equal([]service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}}))
+		})
+
+		It("still accepts basic authentication", func() {
+			assertServiceInstanceList(url, []service.Instance{})
+		})
+
+		It("records the client a token was issued to as the request user", func() {
+			resp, err := getWithBearerToken(url, obtainToken(username, password))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			resp, err = getWithBasicAuth(fmt.Sprintf("http://localhost:%s/requests", appPort))
+			Expect(err).NotTo(HaveOccurred())
+			var requests []struct {
+				User string `json:"user"`
+			}
+			Expect(json.NewDecoder(resp.Body).Decode(&requests)).To(Succeed())
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].User).To(Equal(username))
+		})
+
+		It("does not issue a token for invalid client credentials", func() {
+			req, err := http.NewRequest("POST", tokenURL(), strings.NewReader("grant_type=client_credentials"))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(username, "wrong-password")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects a token signed by another key", func() {
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+
+			resp, err := getWithBearerToken(url, signToken(otherKey, time.Now().Add(time.Hour)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects an expired token", func() {
+			resp, err := getWithBearerToken(url, signToken(signingKey, time.Now().Add(-time.Minute)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects a malformed token", func() {
+			resp, err := getWithBearerToken(url, "not-a-token")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("when TLS_CERT and CLIENT_CA_CERT are set", func() {
+		var (
+			serverCA   *testCA
+			clientCA   *testCA
+			httpsURL   string
+			clientCert tls.Certificate
+		)
+
+		BeforeEach(func() {
+			serverCA = newTestCA()
+			clientCA = newTestCA()
+			serverCertPEM, serverKeyPEM := serverCA.issue("localhost", x509.ExtKeyUsageServerAuth)
+			clientCert = clientCA.issueTLSCertificate("broker", x509.ExtKeyUsageClientAuth)
+
+			os.Setenv("TLS_CERT", string(serverCertPEM))
+			os.Setenv("TLS_KEY", string(serverKeyPEM))
+			os.Setenv("CLIENT_CA_CERT", string(clientCA.certPEM))
+			restartServer()
+
+			httpsURL = fmt.Sprintf("https://localhost:%s/service_instances", appPort)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("TLS_CERT")
+			os.Unsetenv("TLS_KEY")
+			os.Unsetenv("CLIENT_CA_CERT")
+		})
+
+		tlsClient := func(certificates ...tls.Certificate) *http.Client {
+			rootCAs := x509.NewCertPool()
+			rootCAs.AppendCertsFromPEM(serverCA.certPEM)
+			return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      rootCAs,
+				Certificates: certificates,
+			}}}
+		}
+
+		getWithClient := func(client *http.Client) (*http.Response, error) {
+			req, err := http.NewRequest("GET", httpsURL, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth(username, password)
+			return client.Do(req)
+		}
+
+		It("accepts a client certificate signed by CLIENT_CA_CERT", func() {
+			resp, err := getWithClient(tlsClient(clientCert))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("rejects a client without a certificate", func() {
+			_, err := getWithClient(tlsClient())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects a client certificate signed by another CA", func() {
+			otherCert := newTestCA().issueTLSCertificate("broker", x509.ExtKeyUsageClientAuth)
+			_, err := getWithClient(tlsClient(otherCert))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when STATE_FILE is set", func() {
+		var stateDir string
+
+		BeforeEach(func() {
+			var err error
+			stateDir, err = ioutil.TempDir("", "example-service-instances-api")
+			Expect(err).NotTo(HaveOccurred())
+			os.Setenv("STATE_FILE", filepath.Join(stateDir, "state.json"))
+			restartServer()
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("STATE_FILE")
+			os.RemoveAll(stateDir)
+		})
+
+		It("returns the service instance lists set before a restart", func() {
+			postWithBasicAuth(url+"?foo=bar", `[{"service_instance_id":"instance1","plan_id":"plan1"}]`)
+			postWithBasicAuth(url, `[{"service_instance_id":"instance2","plan_id":"plan2"}]`)
+
+			restartServer()
+
+			assertServiceInstanceList(url+"?foo=bar", []service.Instance{{GUID: "instance1", PlanUniqueID: "plan1"}})
+			assertServiceInstanceList(url, []service.Instance{{GUID: "instance2", PlanUniqueID: "plan2"}})
+		})
+
+		It("keeps failing with a forced error after a restart", func() {
+			postWithBasicAuth(url+"?a=b&status-code=503&error-description=down", `[]`)
+
+			restartServer()
+
+			assertErrorResponseWithDescription(url+"?a=b", http.StatusServiceUnavailable, "down")
+			assertServiceInstanceList(url, []service.Instance{})
+		})
+
+		It("continues a sequence of responses from where it was before a restart", func() {
+			postWithBasicAuth(url+"?sequence=true", `[{"status_code": 503}, {"status_code": 500}, {}]`)
+			assertErrorResponse(url, http.StatusServiceUnavailable)
+
+			restartServer()
+
+			assertErrorResponse(url, http.StatusInternalServerError)
+			assertServiceInstanceList(url, []service.Instance{})
+		})
+
+		It("fails to start when the state file is not valid", func() {
+			gexec.KillAndWait()
+			Expect(ioutil.WriteFile(os.Getenv("STATE_FILE"), []byte("not-json"), 0644)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(pathToExe), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("error parsing state file"))
+		})
+
+		It("fails to start when a persisted forced error has an invalid status code", func() {
+			gexec.KillAndWait()
+			Expect(ioutil.WriteFile(os.Getenv("STATE_FILE"), []byte(`{"forced_errors": {"": {"status_code": 0}}}`), 0644)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(pathToExe), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("invalid forced error status_code 0"))
+		})
+
+		It("fails to start when a persisted sequence has an invalid status code", func() {
+			gexec.KillAndWait()
+			Expect(ioutil.WriteFile(os.Getenv("STATE_FILE"), []byte(`{"sequences": {"": {"responses": [{"status_code": 1000}], "position": 0}}}`), 0644)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(pathToExe), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("invalid sequence"))
+		})
+	})
 })
 
 func getWithErrorHeader(url, header, headerVal string) (*http.Response, error) {
@@ -139,6 +695,105 @@ func startServerWithEnv(username, password string) {
 	}).ShouldNot(HaveOccurred())
 }
 
+type testCA struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCA() *testCA {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &testCA{cert: cert, key: key, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM
+}
+
+func (ca *testCA) issueTLSCertificate(commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	certPEM, keyPEM := ca.issue(commonName, usage)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+func tokenURL() string {
+	return fmt.Sprintf("http://localhost:%s/oauth/token", appPort)
+}
+
+func obtainToken(clientID, clientSecret string) string {
+	req, err := http.NewRequest("POST", tokenURL(), strings.NewReader("grant_type=client_credentials"))
+	Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	Expect(json.NewDecoder(resp.Body).Decode(&token)).To(Succeed())
+	Expect(token.ExpiresIn).To(BeNumerically(">", 0))
+	return token.AccessToken
+}
+
+func signToken(key *rsa.PrivateKey, expiresAt time.Time) string {
+	encode := func(v interface{}) string {
+		content, err := json.Marshal(v)
+		Expect(err).NotTo(HaveOccurred())
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]interface{}{"exp": expiresAt.Unix()})
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, hashed[:])
+	Expect(err).NotTo(HaveOccurred())
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func getWithBearerToken(url, token string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("Authorization", "bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+func restartServer() {
+	gexec.KillAndWait()
+	startServerWithEnv(username, password)
+}
+
 func assertServiceInstanceList(url string, expectedInstances []service.Instance) {
 	resp, err := getWithBasicAuth(url)
 	Expect(err).NotTo(HaveOccurred())
@@ -155,6 +810,10 @@ func assertServiceInstanceList(url string, expectedInstances []service.Instance)
 }
 
 func assertErrorResponse(url string, expectedStatusCode int) {
+	assertErrorResponseWithDescription(url, expectedStatusCode, "a forced error")
+}
+
+func assertErrorResponseWithDescription(url string, expectedStatusCode int, expectedDescription string) {
 	resp, err := getWithBasicAuth(url)
 	Expect(err).NotTo(HaveOccurred())
 	Expect(resp.StatusCode).To(Equal(expectedStatusCode))
@@ -163,5 +822,5 @@ func assertErrorResponse(url string, expectedStatusCode int) {
 	content, err := ioutil.ReadAll(resp.Body)
 	Expect(err).NotTo(HaveOccurred())
 
-	Expect(string(content)).To(Equal(`{"description": "a forced error"}`))
+	Expect(content).To(MatchJSON(fmt.Sprintf(`{"description": %q}`, expectedDescription)))
 }
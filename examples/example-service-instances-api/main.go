@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,17 +12,25 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
+const defaultErrorDescription = "a forced error"
+
 var (
-	state      *sync.Map
-	statusCode uint32
+	state        *sync.Map
+	forcedErrors *sync.Map
 )
 
+type forcedError struct {
+	StatusCode  int           `json:"status_code"`
+	Description string        `json:"description"`
+	Delay       time.Duration `json:"delay"`
+}
+
 func init() {
 	state = &sync.Map{}
-	atomic.StoreUint32(&statusCode, 200)
+	forcedErrors = &sync.Map{}
 }
 
 func key(queryParams url.Values) string {
@@ -32,8 +41,11 @@ func key(queryParams url.Values) string {
 	sort.Strings(keys)
 	var keyElements []string
 	for _, k := range keys {
-		values := queryParams[k]
-		keyElements = append(keyElements, fmt.Sprintf("%s=%s", k, values[0]))
+		values := append([]string{}, queryParams[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			keyElements = append(keyElements, fmt.Sprintf("%s=%s", k, v))
+		}
 	}
 
 	return strings.Join(keyElements, "&")
@@ -44,11 +56,6 @@ func setState(queryParams url.Values, val []byte) {
 }
 
 func getState(queryParams url.Values) []byte {
-	errMessage, ok := state.Load("error")
-	if ok {
-		description := fmt.Sprintf(`{"description": "%s"}`, errMessage)
-		return []byte(description)
-	}
 	val, ok := state.Load(key(queryParams))
 	if !ok {
 		return []byte("[]")
@@ -57,9 +64,12 @@ func getState(queryParams url.Values) []byte {
 }
 
 func serviceInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		receivedRequests.record(r)
+	}
+
 	w.Header().Set("WWW-Authenticate", `Basic realm=""`)
-	user, pass, _ := r.BasicAuth()
-	if !checkAuth(user, pass) {
+	if !authorized(r) {
 		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 		return
 	}
@@ -76,47 +86,143 @@ func serviceInstancesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listInstancesHandler(w http.ResponseWriter, r *http.Request) {
-	responseCode := int(atomic.LoadUint32(&statusCode))
+	queryParams := r.URL.Query()
+	rawPage := ""
+	if pageSize > 0 {
+		rawPage = pageParam(queryParams)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(responseCode)
-	w.Write(getState(r.URL.Query()))
+
+	if val, ok := forcedErrors.Load(key(queryParams)); ok {
+		writeForcedError(w, val.(forcedError))
+		return
+	}
+
+	page, err := parsePage(rawPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s, ok := getSequence(queryParams); ok {
+		// Only a first page moves the sequence on, so that all pages of a
+		// list come from the same scripted response.
+		var response scriptedResponse
+		if page == 1 {
+			response = s.next()
+		} else {
+			response = s.current()
+		}
+		if err := persistState(); err != nil {
+			log.Printf("error persisting state: %s\n", err)
+		}
+		if pageSize > 0 && response.StatusCode == http.StatusOK {
+			content := []byte(response.Body)
+			if len(content) == 0 {
+				content = []byte("[]")
+			}
+			response.Body = paginate(r, page, content)
+		}
+		writeScriptedResponse(w, response)
+		return
+	}
+
+	content := getState(queryParams)
+	if pageSize > 0 {
+		content = paginate(r, page, content)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+func writeForcedError(w http.ResponseWriter, e forcedError) {
+	time.Sleep(e.Delay)
+	description := e.Description
+	if description == "" {
+		description = defaultErrorDescription
+	}
+	body, _ := json.Marshal(map[string]string{"description": description})
+	w.WriteHeader(e.StatusCode)
+	w.Write(body)
 }
 
 func setInstanceResponse(w http.ResponseWriter, r *http.Request) {
-	forcedError, values := checkStatusCodeParam(r)
-	if !forcedError {
+	forced, values, err := checkStatusCodeParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isSequence := values.Get("sequence") == "true"
+	values.Del("sequence")
+
+	if forced != nil && forced.StatusCode != http.StatusOK {
+		setForcedError(values, *forced)
+	} else {
+		if forced != nil {
+			removeForcedError(values)
+		}
 		bodyContent, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, "POST body not readable", http.StatusInternalServerError)
 		}
-		setState(values, bodyContent)
+		if isSequence {
+			s, err := parseSequence(bodyContent)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			setSequence(values, s)
+		} else {
+			removeSequence(values)
+			setState(values, bodyContent)
+		}
+	}
+	if err := persistState(); err != nil {
+		log.Printf("error persisting state: %s\n", err)
+		http.Error(w, "state not persisted", http.StatusInternalServerError)
 	}
 }
 
-func checkStatusCodeParam(r *http.Request) (bool, url.Values) {
+// checkStatusCodeParam strips the forced error params from the query, so
+// that the remaining params identify the instance list the error applies to.
+func checkStatusCodeParam(r *http.Request) (*forcedError, url.Values, error) {
 	values := r.URL.Query()
 	e := values.Get("status-code")
-	if code, err := strconv.Atoi(e); err == nil {
-		if code == http.StatusOK {
-			return removeForcedError(values)
-		}
+	description := values.Get("error-description")
+	delay := values.Get("delay")
+	values.Del("status-code")
+	values.Del("error-description")
+	values.Del("delay")
+
+	code, err := strconv.Atoi(e)
+	if err != nil {
+		return nil, values, nil
+	}
+	if !validStatusCode(code) {
+		return nil, values, fmt.Errorf("invalid status-code %q", e)
+	}
 
-		return setForcedError(uint32(code)), values
+	forced := forcedError{StatusCode: code, Description: description}
+	if delay != "" {
+		forced.Delay, err = time.ParseDuration(delay)
+		if err != nil {
+			return nil, values, fmt.Errorf("invalid delay %q: %s", delay, err)
+		}
 	}
-	return false, values
+	return &forced, values, nil
 }
 
-func setForcedError(errorStatusCode uint32) bool {
-	atomic.StoreUint32(&statusCode, errorStatusCode)
-	state.Store("error", "a forced error")
-	return true
+// validStatusCode reports whether code can be passed to WriteHeader.
+func validStatusCode(code int) bool {
+	return code >= 100 && code <= 599
 }
 
-func removeForcedError(values url.Values) (bool, url.Values) {
-	atomic.StoreUint32(&statusCode, http.StatusOK)
-	state.Delete("error")
-	values.Del("status-code")
-	return false, values
+func setForcedError(values url.Values, e forcedError) {
+	forcedErrors.Store(key(values), e)
+}
+
+func removeForcedError(values url.Values) {
+	forcedErrors.Delete(key(values))
 }
 
 func checkAuth(user, pass string) bool {
@@ -126,8 +232,60 @@ func checkAuth(user, pass string) bool {
 }
 
 func main() {
+	stateFile = os.Getenv("STATE_FILE")
+	if stateFile != "" {
+		if err := loadState(stateFile); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		log.Printf("Persisting state to %s\n", stateFile)
+	}
+
+	if size := os.Getenv("REQUEST_LOG_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid REQUEST_LOG_SIZE %q\n", size)
+		}
+		receivedRequests = newRequestLog(n)
+	}
+
+	if size := os.Getenv("PAGE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid PAGE_SIZE %q\n", size)
+		}
+		pageSize = n
+	}
+
+	if keyPEM := os.Getenv("JWT_SIGNING_KEY"); keyPEM != "" {
+		var err error
+		signingKey, err = parseSigningKey(keyPEM)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		http.HandleFunc("/oauth/token", tokenHandler)
+	}
+
 	http.HandleFunc("/service_instances", serviceInstancesHandler)
+	http.HandleFunc("/requests", requestsHandler)
 	addr := fmt.Sprintf(":%s", os.Getenv("PORT"))
-	log.Printf("Listening on %s\n", addr)
-	http.ListenAndServe(addr, nil)
+	server := &http.Server{Addr: addr}
+
+	certPEM := os.Getenv("TLS_CERT")
+	clientCAPEM := os.Getenv("CLIENT_CA_CERT")
+	if certPEM == "" {
+		if clientCAPEM != "" {
+			log.Fatalf("CLIENT_CA_CERT requires TLS_CERT and TLS_KEY to be set\n")
+		}
+		log.Printf("Listening on %s\n", addr)
+		server.ListenAndServe()
+		return
+	}
+
+	tlsConfig, err := buildTLSConfig(certPEM, os.Getenv("TLS_KEY"), clientCAPEM)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	server.TLSConfig = tlsConfig
+	log.Printf("Listening with TLS on %s\n", addr)
+	server.ListenAndServeTLS("", "")
 }
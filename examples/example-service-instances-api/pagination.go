@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// pageSize is the number of service instances returned per page. When it is
+// zero, instance lists are returned as a bare JSON array.
+var pageSize int
+
+type instancesPage struct {
+	ServiceInstances []json.RawMessage `json:"service_instances"`
+	NextPageURL      string            `json:"next_page_url,omitempty"`
+}
+
+// pageParam strips the page param from queryParams, so that all pages of a
+// list share the same key, and returns its unparsed value.
+func pageParam(queryParams url.Values) string {
+	p := queryParams.Get("page")
+	queryParams.Del("page")
+	return p
+}
+
+func parsePage(p string) (int, error) {
+	if p == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(p)
+	if err != nil || page < 1 {
+		return 0, fmt.Errorf("invalid page %q", p)
+	}
+	return page, nil
+}
+
+// paginate wraps the requested page of an instance list in an envelope
+// pointing at the next page. Content that is not a JSON array is returned
+// unchanged.
+func paginate(r *http.Request, page int, content []byte) []byte {
+	var instances []json.RawMessage
+	if err := json.Unmarshal(content, &instances); err != nil {
+		return content
+	}
+
+	result := instancesPage{ServiceInstances: []json.RawMessage{}}
+	// Pages past the end are empty; checking before multiplying keeps a huge
+	// page from overflowing start.
+	if page <= len(instances)/pageSize+1 {
+		start := (page - 1) * pageSize
+		end := start + pageSize
+		if end < len(instances) {
+			next := r.URL.Query()
+			next.Set("page", strconv.Itoa(page+1))
+			result.NextPageURL = (&url.URL{Path: r.URL.Path, RawQuery: next.Encode()}).String()
+		} else {
+			end = len(instances)
+		}
+		result.ServiceInstances = instances[start:end]
+	}
+
+	body, _ := json.Marshal(result)
+	return body
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultRequestLogSize = 100
+
+var receivedRequests = newRequestLog(defaultRequestLogSize)
+
+type recordedRequest struct {
+	Time        time.Time           `json:"time"`
+	QueryParams map[string][]string `json:"query_params"`
+	User        string              `json:"user"`
+	Headers     map[string][]string `json:"headers"`
+}
+
+// requestLog is a ring buffer holding the most recent requests.
+type requestLog struct {
+	lock     sync.Mutex
+	size     int
+	start    int
+	requests []recordedRequest
+}
+
+func newRequestLog(size int) *requestLog {
+	return &requestLog{size: size}
+}
+
+func (l *requestLog) record(r *http.Request) {
+	headers := r.Header.Clone()
+	headers.Del("Authorization")
+	recorded := recordedRequest{
+		Time:        time.Now().UTC(),
+		QueryParams: r.URL.Query(),
+		User:        requestUser(r),
+		Headers:     headers,
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.requests) < l.size {
+		l.requests = append(l.requests, recorded)
+		return
+	}
+	l.requests[l.start] = recorded
+	l.start = (l.start + 1) % l.size
+}
+
+func (l *requestLog) all() []recordedRequest {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	all := make([]recordedRequest, 0, len(l.requests))
+	all = append(all, l.requests[l.start:]...)
+	return append(all, l.requests[:l.start]...)
+}
+
+func (l *requestLog) clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.requests = nil
+	l.start = 0
+}
+
+func requestsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm=""`)
+	if !authorized(r) {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		body, err := json.Marshal(receivedRequests.all())
+		if err != nil {
+			http.Error(w, "requests not serializable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	case "DELETE":
+		receivedRequests.clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Page not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var sequences *sync.Map
+
+func init() {
+	sequences = &sync.Map{}
+}
+
+type scriptedResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Delay      time.Duration   `json:"delay"`
+}
+
+// responseSequence hands out its responses in order and keeps returning the
+// last one once the others have been consumed.
+type responseSequence struct {
+	lock       sync.Mutex
+	responses  []scriptedResponse
+	position   int
+	lastServed int
+}
+
+type persistedSequence struct {
+	Responses  []scriptedResponse `json:"responses"`
+	Position   int                `json:"position"`
+	LastServed int                `json:"last_served"`
+}
+
+func newResponseSequence(responses []scriptedResponse) *responseSequence {
+	return &responseSequence{responses: responses, lastServed: -1}
+}
+
+func (s *responseSequence) next() scriptedResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.advance()
+}
+
+// current returns the response served last, so that later pages of a list
+// come from the same response as its first page. Before anything has been
+// served it behaves like next.
+func (s *responseSequence) current() scriptedResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.lastServed < 0 {
+		return s.advance()
+	}
+	return s.responses[s.lastServed]
+}
+
+func (s *responseSequence) advance() scriptedResponse {
+	s.lastServed = s.position
+	if s.position < len(s.responses)-1 {
+		s.position++
+	}
+	return s.responses[s.lastServed]
+}
+
+func (s *responseSequence) snapshot() persistedSequence {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return persistedSequence{Responses: s.responses, Position: s.position, LastServed: s.lastServed}
+}
+
+func setSequence(queryParams url.Values, s *responseSequence) {
+	sequences.Store(key(queryParams), s)
+}
+
+func removeSequence(queryParams url.Values) {
+	sequences.Delete(key(queryParams))
+}
+
+func getSequence(queryParams url.Values) (*responseSequence, bool) {
+	val, ok := sequences.Load(key(queryParams))
+	if !ok {
+		return nil, false
+	}
+	return val.(*responseSequence), true
+}
+
+// parseSequence reads a POSTed sequence such as
+// [{"status_code": 503, "delay": "1s"}, {"body": [{"service_instance_id": "a", "plan_id": "b"}]}]
+// where status_code defaults to 200 and delay is optional.
+func parseSequence(content []byte) (*responseSequence, error) {
+	var entries []struct {
+		StatusCode int             `json:"status_code"`
+		Body       json.RawMessage `json:"body"`
+		Delay      string          `json:"delay"`
+	}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("invalid sequence: %s", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("invalid sequence: at least one response is required")
+	}
+
+	var responses []scriptedResponse
+	for i, entry := range entries {
+		response := scriptedResponse{StatusCode: entry.StatusCode, Body: entry.Body}
+		if response.StatusCode == 0 {
+			response.StatusCode = http.StatusOK
+		}
+		if !validStatusCode(response.StatusCode) {
+			return nil, fmt.Errorf("invalid sequence: response %d has invalid status_code %d", i, entry.StatusCode)
+		}
+		if entry.Delay != "" {
+			var err error
+			response.Delay, err = time.ParseDuration(entry.Delay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sequence: response %d has invalid delay %q: %s", i, entry.Delay, err)
+			}
+		}
+		responses = append(responses, response)
+	}
+	return newResponseSequence(responses), nil
+}
+
+func writeScriptedResponse(w http.ResponseWriter, response scriptedResponse) {
+	time.Sleep(response.Delay)
+	body := []byte(response.Body)
+	if len(body) == 0 {
+		if response.StatusCode == http.StatusOK {
+			body = []byte("[]")
+		} else {
+			body, _ = json.Marshal(map[string]string{"description": defaultErrorDescription})
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(body)
+}
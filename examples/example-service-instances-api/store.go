@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	stateFile   string
+	persistLock sync.Mutex
+)
+
+type persistedState struct {
+	Responses    map[string]string            `json:"responses"`
+	ForcedErrors map[string]forcedError       `json:"forced_errors"`
+	Sequences    map[string]persistedSequence `json:"sequences"`
+}
+
+func loadState(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading state file %s: %s", path, err)
+	}
+
+	var persisted persistedState
+	if err := json.Unmarshal(content, &persisted); err != nil {
+		return fmt.Errorf("error parsing state file %s: %s", path, err)
+	}
+
+	for k, v := range persisted.Responses {
+		state.Store(k, []byte(v))
+	}
+	for k, v := range persisted.ForcedErrors {
+		if !validStatusCode(v.StatusCode) {
+			return fmt.Errorf("error parsing state file %s: invalid forced error status_code %d for %q", path, v.StatusCode, k)
+		}
+		forcedErrors.Store(k, v)
+	}
+	for k, v := range persisted.Sequences {
+		if len(v.Responses) == 0 || v.Position < 0 || v.Position >= len(v.Responses) || v.LastServed < -1 || v.LastServed >= len(v.Responses) {
+			return fmt.Errorf("error parsing state file %s: invalid sequence for %q", path, k)
+		}
+		for _, response := range v.Responses {
+			if !validStatusCode(response.StatusCode) {
+				return fmt.Errorf("error parsing state file %s: invalid sequence for %q", path, k)
+			}
+		}
+		sequences.Store(k, &responseSequence{responses: v.Responses, position: v.Position, lastServed: v.LastServed})
+	}
+	return nil
+}
+
+func persistState() error {
+	if stateFile == "" {
+		return nil
+	}
+
+	persistLock.Lock()
+	defer persistLock.Unlock()
+
+	persisted := persistedState{
+		Responses:    map[string]string{},
+		ForcedErrors: map[string]forcedError{},
+		Sequences:    map[string]persistedSequence{},
+	}
+	state.Range(func(k, v interface{}) bool {
+		persisted.Responses[k.(string)] = string(v.([]byte))
+		return true
+	})
+	forcedErrors.Range(func(k, v interface{}) bool {
+		persisted.ForcedErrors[k.(string)] = v.(forcedError)
+		return true
+	})
+	sequences.Range(func(k, v interface{}) bool {
+		persisted.Sequences[k.(string)] = v.(*responseSequence).snapshot()
+		return true
+	})
+
+	content, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(stateFile, content)
+}
+
+// writeFileAtomically writes to a temporary file in the same directory and
+// renames it over path, so a crash never leaves a partially written file.
+func writeFileAtomically(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// buildTLSConfig serves certPEM and, when clientCAPEM is set, requires
+// clients to present a certificate signed by it.
+func buildTLSConfig(certPEM, keyPEM, clientCAPEM string) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing TLS_CERT and TLS_KEY: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAPEM != "" {
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM([]byte(clientCAPEM)) {
+			return nil, errors.New("error parsing CLIENT_CA_CERT: no certificates found")
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
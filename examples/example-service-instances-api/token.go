@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const tokenValidity = time.Hour
+
+// signingKey signs the tokens issued by /oauth/token and verifies bearer
+// tokens. When it is nil, only basic authentication is accepted.
+var signingKey *rsa.PrivateKey
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type tokenClaims struct {
+	ClientID  string `json:"client_id"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func parseSigningKey(keyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM block found in JWT_SIGNING_KEY")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JWT_SIGNING_KEY: %s", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("JWT_SIGNING_KEY is not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func encodeSegment(v interface{}) string {
+	content, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func issueToken(clientID string, now time.Time) (string, error) {
+	signed := encodeSegment(tokenHeader{Alg: "RS256", Typ: "JWT"}) + "." + encodeSegment(tokenClaims{
+		ClientID:  clientID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenValidity).Unix(),
+	})
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(nil, signingKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func verifyToken(token string, now time.Time) (tokenClaims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return tokenClaims{}, errors.New("malformed token")
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(segments[0], &header); err != nil {
+		return tokenClaims{}, err
+	}
+	if header.Alg != "RS256" {
+		return tokenClaims{}, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("malformed token signature: %s", err)
+	}
+	hashed := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	if err := rsa.VerifyPKCS1v15(&signingKey.PublicKey, crypto.SHA256, hashed[:], signature); err != nil {
+		return tokenClaims{}, errors.New("invalid token signature")
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(segments[1], &claims); err != nil {
+		return tokenClaims{}, err
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("malformed token segment: %s", err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("malformed token segment: %s", err)
+	}
+	return nil
+}
+
+// bearerToken returns the bearer token of r, when a signing key is configured
+// and r carries one.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if signingKey == nil || len(header) <= 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return header[7:], true
+}
+
+// authorized accepts the configured basic auth credentials or, when a
+// signing key is configured, a bearer token signed by it.
+func authorized(r *http.Request) bool {
+	if token, ok := bearerToken(r); ok {
+		_, err := verifyToken(token, time.Now())
+		return err == nil
+	}
+
+	user, pass, _ := r.BasicAuth()
+	return checkAuth(user, pass)
+}
+
+// requestUser is the basic auth username of r or, for a valid bearer token,
+// the client it was issued to.
+func requestUser(r *http.Request) string {
+	if token, ok := bearerToken(r); ok {
+		claims, err := verifyToken(token, time.Now())
+		if err != nil {
+			return ""
+		}
+		return claims.ClientID
+	}
+
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// tokenHandler issues tokens the way UAA does for the client_credentials
+// grant, using USERNAME and PASSWORD as the client ID and secret.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	clientID, clientSecret, _ := r.BasicAuth()
+	if !checkAuth(clientID, clientSecret) {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+	if r.PostFormValue("grant_type") != "client_credentials" {
+		http.Error(w, "unsupported grant_type", http.StatusBadRequest)
+		return
+	}
+
+	token, err := issueToken(clientID, time.Now())
+	if err != nil {
+		http.Error(w, "token not issued", http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   int(tokenValidity.Seconds()),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}